@@ -0,0 +1,23 @@
+package mpower
+
+// CheckoutInvoice definition as specified by mpower docs
+// It embeds Invoice and adds the fields mpower assigns once the checkout
+// invoice has been created (the redirect URL and the invoice token).
+type CheckoutInvoice struct {
+	Invoice
+	Token       string `json:"-"`
+	CheckoutURL string `json:"-"`
+}
+
+// NewCheckoutInvoice creates a new CheckoutInvoice for the given store
+//
+// Example.
+//    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
+func NewCheckoutInvoice(setup *Setup, store Store) *CheckoutInvoice {
+	return &CheckoutInvoice{
+		Invoice: Invoice{
+			Setup: setup,
+			Store: store,
+		},
+	}
+}
@@ -1,32 +1,151 @@
 package mpower
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"sync"
+	"time"
 )
 
+// DiscountKind controls how an item's Discount is interpreted when
+// Recalculate derives its TotalPrice.
+type DiscountKind int
+
+const (
+	// DiscountAbsolute treats Discount as a flat amount subtracted from
+	// the line's Quantity * UnitPrice. This is the zero value, so items
+	// added before discounts existed keep behaving the way they always did.
+	DiscountAbsolute DiscountKind = iota
+	// DiscountPercent treats Discount as a percentage (e.g. 10 for 10%)
+	// of the line's Quantity * UnitPrice.
+	DiscountPercent
+)
+
+// removedProductSuffix marks an item's key in the outgoing `items` map as
+// belonging to a product that has since been removed upstream, so the
+// line survives in the request payload for audit purposes without being
+// counted towards the invoice totals.
+const removedProductSuffix = ".removed"
+
 // Item definition as specified by mpower docs
 // It holds the data of an item
 type item struct {
-	Name        string  `json:"name"`
-	Quantity    int     `json:"quantity"`
-	UnitPrice   float32 `json:"unit_price"`
-	TotalPrice  float32 `json:"total_price"`
-	Description string  `json:"description"`
+	Name         string       `json:"name"`
+	Quantity     int          `json:"quantity"`
+	UnitPrice    float32      `json:"unit_price"`
+	TotalPrice   float32      `json:"total_price"`
+	Description  string       `json:"description"`
+	Discount     float32      `json:"discount,omitempty"`
+	DiscountKind DiscountKind `json:"-"`
+	Removed      bool         `json:"-"`
 }
 
+// TaxMode controls how a tax's Amount is interpreted when the invoice
+// totals are derived in Recalculate.
+type TaxMode int
+
+const (
+	// TaxModeFixed treats Amount as a flat currency value added to the
+	// invoice total. This is the zero value, so taxes added before
+	// TaxMode existed keep behaving the way they always did.
+	TaxModeFixed TaxMode = iota
+	// TaxModePercent treats Amount as a percentage (e.g. 15 for 15%) of
+	// the items subtotal, applied on top of it.
+	TaxModePercent
+)
+
 // Tax definition as specified by mpower docs
 // It holds the tax data
 type tax struct {
 	Name   string  `json:"name"`
 	Amount float32 `json:"amount"`
+	Mode   TaxMode `json:"-"`
+}
+
+// InvoiceStatus represents where an invoice is in its lifecycle.
+type InvoiceStatus int
+
+const (
+	// StatusDraft is the zero value: the invoice has not been sent yet.
+	StatusDraft InvoiceStatus = iota
+	StatusPending
+	StatusPaid
+	StatusCancelled
+	StatusRefunded
+	StatusExpired
+)
+
+// String gives the human-readable name for an InvoiceStatus, used in
+// InvalidTransitionError messages and anywhere the status is logged.
+func (s InvoiceStatus) String() string {
+	switch s {
+	case StatusDraft:
+		return "draft"
+	case StatusPending:
+		return "pending"
+	case StatusPaid:
+		return "paid"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusRefunded:
+		return "refunded"
+	case StatusExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// validStatusTransitions maps a status to the set of statuses it may
+// legally transition to via TransitionTo.
+var validStatusTransitions = map[InvoiceStatus][]InvoiceStatus{
+	StatusDraft:     {StatusPending, StatusCancelled},
+	StatusPending:   {StatusPaid, StatusCancelled, StatusExpired},
+	StatusPaid:      {StatusRefunded},
+	StatusCancelled: {},
+	StatusRefunded:  {},
+	StatusExpired:   {},
 }
 
+// InvalidTransitionError is returned by TransitionTo when the requested
+// status change isn't allowed from the invoice's current status.
+type InvalidTransitionError struct {
+	From InvoiceStatus
+	To   InvoiceStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("mpower: invalid invoice status transition from %s to %s", e.From, e.To)
+}
+
+// StatusEvent records a single status change in an invoice's history.
+type StatusEvent struct {
+	From InvoiceStatus
+	To   InvoiceStatus
+	At   time.Time
+	Note string
+}
+
+// StatusHook is invoked whenever an invoice's status changes, whether
+// through SetStatus or TransitionTo. Register one with RegisterStatusHook.
+type StatusHook func(old, new InvoiceStatus, inv *Invoice)
+
 // Invoice definition as specified by mpower docs
 // It holds all the data related to the invoice
 type invoice struct {
 	ItemsArr    []item            `json:"-"`
 	TaxesArr    []tax             `json:"-"`
+	TotalAmount float32           `json:"total_amount"`
+	Description string            `json:"description"`
+	Actions     map[string]string `json:"actions,omitempty"`
+}
+
+// invoiceJSON is the wire shape of invoice: the `items`/`taxes` maps mpower
+// expects, built from ItemsArr/TaxesArr at marshal time by
+// (*Invoice).MarshalJSON instead of being kept as a second,
+// independently-populated map in sync by hand in PrepareForRequest.
+type invoiceJSON struct {
 	Items       map[string]item   `json:"items"`
 	Taxes       map[string]tax    `json:"taxes,omitempty"`
 	TotalAmount float32           `json:"total_amount"`
@@ -43,6 +162,10 @@ type Invoice struct {
 	Store      Store                  `json:"store"`
 	InvoiceIn  invoice                `json:"invoice"`
 	CustomData map[string]interface{} `json:"custom_data,omitempty"`
+
+	Status        InvoiceStatus `json:"-"`
+	StatusHistory []StatusEvent `json:"-"`
+	statusHooks   []StatusHook  `json:"-"`
 }
 
 // AddItem add an `item - struct` to the items in the invoice
@@ -51,6 +174,9 @@ type Invoice struct {
 //    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
 //    checkout.AddItem("Yam Phone", 1, 50.00, 50.00, "Hello World")
 func (i *Invoice) AddItem(name string, quantity int, unitPrice float32, totalPrice float32, desc string) error {
+	i.Lock()
+	defer i.Unlock()
+
 	for _, value := range i.InvoiceIn.ItemsArr {
 		if value.Name == name {
 			return fmt.Errorf("Invoice item with name %s already exists", name)
@@ -67,11 +193,42 @@ func (i *Invoice) AddItem(name string, quantity int, unitPrice float32, totalPri
 	return nil
 }
 
+// AddDiscountedItem adds an `item - struct` with a discount applied to its
+// line total by Recalculate. kind is DiscountAbsolute for a flat amount
+// off, or DiscountPercent for a percentage of Quantity * UnitPrice.
+//
+// Example.
+//    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
+//    checkout.AddDiscountedItem("Yam Phone", 1, 50.00, "Hello World", 10.00, mpower.DiscountPercent)
+func (i *Invoice) AddDiscountedItem(name string, quantity int, unitPrice float32, desc string, discount float32, kind DiscountKind) error {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, value := range i.InvoiceIn.ItemsArr {
+		if value.Name == name {
+			return fmt.Errorf("Invoice item with name %s already exists", name)
+		}
+	}
+	tempItem := item{}
+	tempItem.Name = name
+	tempItem.Quantity = quantity
+	tempItem.UnitPrice = unitPrice
+	tempItem.Description = desc
+	tempItem.Discount = discount
+	tempItem.DiscountKind = kind
+
+	i.InvoiceIn.ItemsArr = append(i.InvoiceIn.ItemsArr, tempItem)
+	return nil
+}
+
 // RemoveItem removes the item with name of `name`
 //
 // Example.
 //     checkout.RemoveItem()
 func (i *Invoice) RemoveItem(name string) {
+	i.Lock()
+	defer i.Unlock()
+
 	for ix, value := range i.InvoiceIn.ItemsArr {
 		if value.Name == name {
 			i.InvoiceIn.ItemsArr = append(i.InvoiceIn.ItemsArr[:ix], i.InvoiceIn.ItemsArr[ix+1:]...)
@@ -80,13 +237,36 @@ func (i *Invoice) RemoveItem(name string) {
 	}
 }
 
+// MarkItemRemoved flags the item with name of `name` as removed instead of
+// deleting it from ItemsArr, the way RemoveItem does. A removed item is
+// still rendered into the outgoing `items` map (under an `item_N.removed`
+// key) so integrators keep an audit trail of what was originally billed,
+// but Recalculate excludes it from the invoice totals.
+//
+// Example.
+//     checkout.MarkItemRemoved("Yam Phone")
+func (i *Invoice) MarkItemRemoved(name string) {
+	i.Lock()
+	defer i.Unlock()
+
+	for ix, value := range i.InvoiceIn.ItemsArr {
+		if value.Name == name {
+			value.Removed = true
+			i.InvoiceIn.ItemsArr[ix] = value
+			break
+		}
+	}
+}
+
 // ClearAllItems clears all the items in the invoice
 //
 // Example.
 //     checkout.ClearAllItems()
 func (i *Invoice) ClearAllItems() {
+	i.Lock()
+	defer i.Unlock()
+
 	i.InvoiceIn.ItemsArr = nil
-	i.InvoiceIn.Items = make(map[string]item)
 }
 
 // AddItem add an `tax - struct` to the taxes in the invoice
@@ -95,6 +275,9 @@ func (i *Invoice) ClearAllItems() {
 //    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
 //    checkout.AddTax("VAT", 30.00)
 func (i *Invoice) AddTax(name string, amount float32) error {
+	i.Lock()
+	defer i.Unlock()
+
 	for _, value := range i.InvoiceIn.TaxesArr {
 		if value.Name == name {
 			return fmt.Errorf("Tax with %s already exists", name)
@@ -103,6 +286,31 @@ func (i *Invoice) AddTax(name string, amount float32) error {
 	tempTax := tax{}
 	tempTax.Name = name
 	tempTax.Amount = amount
+	tempTax.Mode = TaxModeFixed
+
+	i.InvoiceIn.TaxesArr = append(i.InvoiceIn.TaxesArr, tempTax)
+	return nil
+}
+
+// AddPercentTax adds a `tax - struct` whose Amount is a percentage of the
+// items subtotal rather than a fixed amount.
+//
+// Example.
+//    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
+//    checkout.AddPercentTax("VAT", 15.00)
+func (i *Invoice) AddPercentTax(name string, percent float32) error {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, value := range i.InvoiceIn.TaxesArr {
+		if value.Name == name {
+			return fmt.Errorf("Tax with %s already exists", name)
+		}
+	}
+	tempTax := tax{}
+	tempTax.Name = name
+	tempTax.Amount = percent
+	tempTax.Mode = TaxModePercent
 
 	i.InvoiceIn.TaxesArr = append(i.InvoiceIn.TaxesArr, tempTax)
 	return nil
@@ -113,6 +321,9 @@ func (i *Invoice) AddTax(name string, amount float32) error {
 // Example.
 //     checkout.RemoveTax()
 func (i *Invoice) RemoveTax(name string) {
+	i.Lock()
+	defer i.Unlock()
+
 	for ix, value := range i.InvoiceIn.TaxesArr {
 		if value.Name == name {
 			i.InvoiceIn.TaxesArr = append(i.InvoiceIn.TaxesArr[:ix], i.InvoiceIn.TaxesArr[ix+1:]...)
@@ -126,8 +337,10 @@ func (i *Invoice) RemoveTax(name string) {
 // Example.
 //     checkout.ClearAllTaxes()
 func (i *Invoice) ClearAllTaxes() {
+	i.Lock()
+	defer i.Unlock()
+
 	i.InvoiceIn.TaxesArr = nil
-	i.InvoiceIn.Taxes = make(map[string]tax)
 }
 
 // Clear clears all the items in the invoice
@@ -144,12 +357,15 @@ func (i *Invoice) Clear() {
 // Example.
 //    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
 //    checkout.SetDescription("Hello World")
-func (i *Invoice) SetDescription(desc string) {
+func (i *Invoice) SetDescription(desc string) error {
 	if desc == "" {
-		panic("provide the description argument")
+		return fmt.Errorf("provide the description argument")
 	}
 
+	i.Lock()
 	i.InvoiceIn.Description = desc
+	i.Unlock()
+	return nil
 }
 
 // Sets the total amount on the invoice
@@ -157,12 +373,15 @@ func (i *Invoice) SetDescription(desc string) {
 // Example.
 //    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
 //    checkout.SetTotalAmount(80.00)
-func (i *Invoice) SetTotalAmount(amt float32) {
+func (i *Invoice) SetTotalAmount(amt float32) error {
 	if amt == 0 {
-		panic("provide the totalAmount argument")
+		return fmt.Errorf("provide the totalAmount argument")
 	}
 
+	i.Lock()
 	i.InvoiceIn.TotalAmount = amt
+	i.Unlock()
+	return nil
 }
 
 // Sets the total amount on the invoice
@@ -171,42 +390,219 @@ func (i *Invoice) SetTotalAmount(amt float32) {
 //    checkout := mpower.NewCheckoutInvoice(newSetup, newStore)
 //    checkout.SetCustomData("bonus", yeah)
 func (i *Invoice) SetCustomData(key string, val interface{}) {
+	i.Lock()
 	if i.CustomData == nil {
 		i.CustomData = make(map[string]interface{})
 	}
-	i.Lock()
 	i.CustomData[key] = val
 	i.Unlock()
 }
 
-func (i *Invoice) PrepareForRequest() {
-	i.InvoiceIn.Items = make(map[string]item)
-	i.InvoiceIn.Taxes = make(map[string]tax)
+// SetStatus sets the invoice status directly, without validating that the
+// change is a legal lifecycle transition, and runs any registered status
+// hooks. Use TransitionTo instead when the change needs to be validated
+// and recorded in StatusHistory.
+func (i *Invoice) SetStatus(status InvoiceStatus) {
+	i.Lock()
+	old := i.Status
+	i.Status = status
+	i.Unlock()
+
+	i.runStatusHooks(old, status)
+}
 
-	// Check the section on `concurrrency` http://blog.golang.org/go-maps-in-action
-	// http://golang.org/doc/faq#atomic_maps
+// TransitionTo moves the invoice to status, recording a StatusEvent (with
+// an optional note) in StatusHistory and running any registered status
+// hooks. It returns an *InvalidTransitionError, rather than panicking, if
+// the change isn't a legal transition from the invoice's current status.
+func (i *Invoice) TransitionTo(status InvoiceStatus, note string) error {
 	i.Lock()
+	current := i.Status
+
+	allowed := false
+	for _, s := range validStatusTransitions[current] {
+		if s == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		i.Unlock()
+		return &InvalidTransitionError{From: current, To: status}
+	}
+
+	i.Status = status
+	i.StatusHistory = append(i.StatusHistory, StatusEvent{
+		From: current,
+		To:   status,
+		At:   time.Now(),
+		Note: note,
+	})
+	i.Unlock()
 
+	i.runStatusHooks(current, status)
+	return nil
+}
+
+// RegisterStatusHook registers a function to be called whenever the
+// invoice's status changes via SetStatus or TransitionTo.
+func (i *Invoice) RegisterStatusHook(hook StatusHook) {
+	i.Lock()
+	i.statusHooks = append(i.statusHooks, hook)
+	i.Unlock()
+}
+
+func (i *Invoice) runStatusHooks(old, new InvoiceStatus) {
+	i.RLock()
+	hooks := make([]StatusHook, len(i.statusHooks))
+	copy(hooks, i.statusHooks)
+	i.RUnlock()
+
+	for _, hook := range hooks {
+		hook(old, new, i)
+	}
+}
+
+// roundMoney rounds a float32 amount to 2 decimal places, which is the
+// rounding policy Recalculate uses to keep float32 drift out of totals.
+func roundMoney(amt float32) float32 {
+	return float32(math.Round(float64(amt)*100) / 100)
+}
+
+// Recalculate derives each item's TotalPrice from Quantity * UnitPrice,
+// less its Discount, and sums the items plus taxes into
+// InvoiceIn.TotalAmount. Fixed taxes (TaxModeFixed) add their Amount
+// directly; percentage taxes (TaxModePercent) are applied as a percentage
+// of the items subtotal. Items flagged Removed still get a TotalPrice so
+// they render correctly into the outgoing request, but are excluded from
+// the subtotal and totals. It is called automatically from
+// PrepareForRequest, so callers no longer need to compute totalPrice per
+// line or call SetTotalAmount by hand.
+func (i *Invoice) Recalculate() {
+	i.Lock()
+	defer i.Unlock()
+
+	var subtotal float32
+	for ix, value := range i.InvoiceIn.ItemsArr {
+		gross := float32(value.Quantity) * value.UnitPrice
+		switch value.DiscountKind {
+		case DiscountPercent:
+			gross -= gross * value.Discount / 100
+		default:
+			gross -= value.Discount
+		}
+		value.TotalPrice = roundMoney(gross)
+		i.InvoiceIn.ItemsArr[ix] = value
+
+		if value.Removed {
+			continue
+		}
+		subtotal += value.TotalPrice
+	}
+
+	total := subtotal
+	for _, value := range i.InvoiceIn.TaxesArr {
+		switch value.Mode {
+		case TaxModePercent:
+			total += roundMoney(subtotal * value.Amount / 100)
+		default:
+			total += value.Amount
+		}
+	}
+
+	i.InvoiceIn.TotalAmount = roundMoney(total)
+}
+
+// PrepareForRequest refreshes the invoice totals before it's sent to
+// mpower. The `items`/`taxes` maps themselves no longer need to be built
+// here: MarshalJSON derives them straight from ItemsArr/TaxesArr at
+// encoding time, so there's a single source of truth instead of a second
+// map that PrepareForRequest had to keep in sync by hand.
+func (i *Invoice) PrepareForRequest() {
+	i.Recalculate()
+}
+
+// MarshalJSON renders the invoice's `items`/`taxes` maps from
+// ItemsArr/TaxesArr under RLock, so a concurrent mutator can never be
+// observed mid-mutation by a goroutine marshaling the invoice for a
+// request.
+func (i *Invoice) MarshalJSON() ([]byte, error) {
+	i.RLock()
+	defer i.RUnlock()
+
+	items := make(map[string]item, len(i.InvoiceIn.ItemsArr))
 	for ix, value := range i.InvoiceIn.ItemsArr {
 		itemName := fmt.Sprintf("item_%d", ix)
-		i.InvoiceIn.Items[itemName] = item{}
-		tempItem := i.InvoiceIn.Items[itemName]
-		tempItem.Name = value.Name
-		tempItem.Quantity = value.Quantity
-		tempItem.UnitPrice = value.UnitPrice
-		tempItem.TotalPrice = value.TotalPrice
-		tempItem.Description = value.Description
-		i.InvoiceIn.Items[itemName] = tempItem
+		if value.Removed {
+			itemName += removedProductSuffix
+		}
+		items[itemName] = value
 	}
 
+	taxes := make(map[string]tax, len(i.InvoiceIn.TaxesArr))
 	for ix, value := range i.InvoiceIn.TaxesArr {
-		taxName := fmt.Sprintf("tax_%d", ix)
-		i.InvoiceIn.Taxes[taxName] = tax{}
-		tempTax := i.InvoiceIn.Taxes[taxName]
-		tempTax.Name = value.Name
-		tempTax.Amount = value.Amount
-		i.InvoiceIn.Taxes[taxName] = tempTax
+		taxes[fmt.Sprintf("tax_%d", ix)] = value
 	}
 
-	i.Unlock()
+	type alias Invoice
+	return json.Marshal(struct {
+		*alias
+		InvoiceIn invoiceJSON `json:"invoice"`
+	}{
+		alias: (*alias)(i),
+		InvoiceIn: invoiceJSON{
+			Items:       items,
+			Taxes:       taxes,
+			TotalAmount: i.InvoiceIn.TotalAmount,
+			Description: i.InvoiceIn.Description,
+			Actions:     i.InvoiceIn.Actions,
+		},
+	})
+}
+
+// Duplicate returns a new *Invoice cloning this invoice's items, taxes,
+// description and custom data, but resetting server-assigned state:
+// Status and StatusHistory are left at their zero values, as is
+// TotalAmount, which PrepareForRequest recomputes. Setup is carried over
+// by reference and Store is copied by value.
+//
+// Example.
+//    dup := checkout.Duplicate()
+func (i *Invoice) Duplicate() *Invoice {
+	i.RLock()
+	defer i.RUnlock()
+
+	items := make([]item, len(i.InvoiceIn.ItemsArr))
+	copy(items, i.InvoiceIn.ItemsArr)
+
+	taxes := make([]tax, len(i.InvoiceIn.TaxesArr))
+	copy(taxes, i.InvoiceIn.TaxesArr)
+
+	customData := make(map[string]interface{}, len(i.CustomData))
+	for k, v := range i.CustomData {
+		customData[k] = v
+	}
+
+	return &Invoice{
+		Setup: i.Setup,
+		Store: i.Store,
+		InvoiceIn: invoice{
+			ItemsArr:    items,
+			TaxesArr:    taxes,
+			Description: i.InvoiceIn.Description,
+		},
+		CustomData: customData,
+	}
+}
+
+// NewCheckoutInvoiceFromInvoice builds a *CheckoutInvoice from an existing
+// invoice, the same duplication as Duplicate but for callers
+// that need the result as a concrete CheckoutInvoice rather than the
+// embedded Invoice. The clone is independent of src: mutating one's items,
+// taxes or custom data never leaks into the other.
+//
+// Example.
+//    dup := mpower.NewCheckoutInvoiceFromInvoice(checkout)
+func NewCheckoutInvoiceFromInvoice(src *Invoice) *CheckoutInvoice {
+	return &CheckoutInvoice{Invoice: *src.Duplicate()}
 }
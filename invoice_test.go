@@ -0,0 +1,222 @@
+package mpower
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestInvoice() *Invoice {
+	return &Invoice{
+		Setup: NewSetup("test-key", false),
+		Store: NewStore("Test Store", "", "", ""),
+	}
+}
+
+func TestRecalculateStacksFixedAndPercentTaxes(t *testing.T) {
+	inv := newTestInvoice()
+
+	if err := inv.AddItem("Yam Phone", 2, 50.00, 0, "Hello World"); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if err := inv.AddPercentTax("VAT", 15.00); err != nil {
+		t.Fatalf("AddPercentTax: %v", err)
+	}
+	if err := inv.AddTax("Handling", 5.00); err != nil {
+		t.Fatalf("AddTax: %v", err)
+	}
+
+	inv.Recalculate()
+
+	wantItemTotal := float32(100.00)
+	if got := inv.InvoiceIn.ItemsArr[0].TotalPrice; got != wantItemTotal {
+		t.Errorf("item TotalPrice = %v, want %v", got, wantItemTotal)
+	}
+
+	// subtotal 100, + 15% VAT (15) + fixed 5 handling = 120
+	wantTotal := float32(120.00)
+	if got := inv.InvoiceIn.TotalAmount; got != wantTotal {
+		t.Errorf("TotalAmount = %v, want %v", got, wantTotal)
+	}
+}
+
+func TestDuplicateIsolatesConcurrentCustomData(t *testing.T) {
+	orig := newTestInvoice()
+	if err := orig.AddItem("Yam Phone", 1, 50.00, 0, "Hello World"); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	orig.SetCustomData("shared", "original")
+
+	dup := orig.Duplicate()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		n := n
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			orig.SetCustomData(fmt.Sprintf("orig-%d", n), n)
+		}()
+		go func() {
+			defer wg.Done()
+			dup.SetCustomData(fmt.Sprintf("dup-%d", n), n)
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := orig.CustomData["dup-0"]; ok {
+		t.Errorf("mutation on dup leaked into orig.CustomData")
+	}
+	if _, ok := dup.CustomData["orig-0"]; ok {
+		t.Errorf("mutation on orig leaked into dup.CustomData")
+	}
+	if len(orig.CustomData) != 51 { // "shared" + 50 orig-N keys
+		t.Errorf("orig.CustomData has %d keys, want 51", len(orig.CustomData))
+	}
+	if len(dup.CustomData) != 51 { // cloned "shared" + 50 dup-N keys
+		t.Errorf("dup.CustomData has %d keys, want 51", len(dup.CustomData))
+	}
+
+	dup.InvoiceIn.ItemsArr[0].Name = "Changed"
+	if orig.InvoiceIn.ItemsArr[0].Name == "Changed" {
+		t.Errorf("mutating dup's ItemsArr leaked into orig")
+	}
+}
+
+func TestConcurrentMutatorsDontRace(t *testing.T) {
+	inv := newTestInvoice()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		n := n
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_ = inv.AddItem(fmt.Sprintf("item-%d", n), 1, 10.00, 0, "desc")
+		}()
+		go func() {
+			defer wg.Done()
+			inv.PrepareForRequest()
+		}()
+		go func() {
+			defer wg.Done()
+			inv.SetCustomData(fmt.Sprintf("key-%d", n), n)
+		}()
+	}
+	wg.Wait()
+
+	// One final pass once every AddItem has landed, so the recalculated
+	// totals reflect all 50 additions.
+	inv.PrepareForRequest()
+	if len(inv.InvoiceIn.ItemsArr) != 50 {
+		t.Errorf("ItemsArr has %d items, want 50", len(inv.InvoiceIn.ItemsArr))
+	}
+}
+
+func TestTransitionToIsAtomicUnderConcurrency(t *testing.T) {
+	inv := newTestInvoice()
+	if err := inv.TransitionTo(StatusPending, ""); err != nil {
+		t.Fatalf("TransitionTo(Pending): %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var paid, cancelled int32
+	for n := 0; n < 50; n++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if inv.TransitionTo(StatusPaid, "") == nil {
+				atomic.AddInt32(&paid, 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if inv.TransitionTo(StatusCancelled, "") == nil {
+				atomic.AddInt32(&cancelled, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if paid+cancelled != 1 {
+		t.Errorf("exactly one of Paid/Cancelled should have won the race, got paid=%d cancelled=%d", paid, cancelled)
+	}
+	for _, ev := range inv.StatusHistory {
+		if ev.From == StatusPaid && ev.To == StatusCancelled {
+			t.Errorf("illegal transition recorded: Paid -> Cancelled")
+		}
+	}
+}
+
+func TestMarshalJSONBuildsItemsFromItemsArr(t *testing.T) {
+	inv := newTestInvoice()
+	if err := inv.AddItem("Yam Phone", 1, 50.00, 0, "Hello World"); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	inv.MarkItemRemoved("Yam Phone")
+	if err := inv.AddItem("Case", 2, 10.00, 0, "desc"); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	inv.PrepareForRequest()
+
+	b, err := json.Marshal(inv)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out struct {
+		Invoice struct {
+			Items map[string]item `json:"items"`
+		} `json:"invoice"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if _, ok := out.Invoice.Items["item_0.removed"]; !ok {
+		t.Errorf("expected item_0.removed key in %v", out.Invoice.Items)
+	}
+	if _, ok := out.Invoice.Items["item_1"]; !ok {
+		t.Errorf("expected item_1 key in %v", out.Invoice.Items)
+	}
+}
+
+func TestMarshalJSONDoesNotRaceWithMutators(t *testing.T) {
+	inv := newTestInvoice()
+	if err := inv.AddItem("Yam Phone", 1, 50.00, 0, "Hello World"); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		n := n
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = inv.AddItem(fmt.Sprintf("item-%d", n), 1, 10.00, 0, "desc")
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := json.Marshal(inv); err != nil {
+				t.Errorf("Marshal: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRoundMoney(t *testing.T) {
+	cases := []struct {
+		in, want float32
+	}{
+		{10.005, 10.01},
+		{10.004, 10.00},
+		{0, 0},
+	}
+	for _, c := range cases {
+		if got := roundMoney(c.in); got != c.want {
+			t.Errorf("roundMoney(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
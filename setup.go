@@ -0,0 +1,19 @@
+package mpower
+
+// Setup definition as specified by mpower docs
+// It holds the credentials used to authenticate requests against the mpower API
+type Setup struct {
+	APIKey string
+	Live   bool
+}
+
+// NewSetup creates a new Setup with the given API key
+//
+// Example.
+//    setup := mpower.NewSetup("my-api-key", false)
+func NewSetup(apiKey string, live bool) *Setup {
+	return &Setup{
+		APIKey: apiKey,
+		Live:   live,
+	}
+}
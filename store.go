@@ -0,0 +1,23 @@
+package mpower
+
+// Store definition as specified by mpower docs
+// It holds the store information shown to the customer at checkout
+type Store struct {
+	Name          string `json:"name"`
+	Tagline       string `json:"tagline"`
+	PostalAddress string `json:"postal_address"`
+	Phone         string `json:"phone"`
+}
+
+// NewStore creates a new Store
+//
+// Example.
+//    store := mpower.NewStore("Yam Phone Store", "We sell phones", "PO Box 1", "+233000000000")
+func NewStore(name, tagline, postalAddress, phone string) Store {
+	return Store{
+		Name:          name,
+		Tagline:       tagline,
+		PostalAddress: postalAddress,
+		Phone:         phone,
+	}
+}